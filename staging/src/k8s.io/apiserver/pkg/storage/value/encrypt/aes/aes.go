@@ -0,0 +1,169 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package aes transforms values for storage at rest using AES-GCM.
+package aes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/apiserver/pkg/storage/value"
+)
+
+// commonSize is the length of various security sensitive byte slices such as encryption keys.
+const commonSize = 32
+
+// MinSeedSizeExtendedNonceGCM is the minimum size in bytes of the seed used to derive per-record keys for
+// NewHKDFExtendedNonceGCMTransformer. It must be large enough to be used directly as HKDF input key material.
+const MinSeedSizeExtendedNonceGCM = commonSize
+
+// infoSize is the size in bytes of the randomly generated "info" value mixed into each record's derived key.
+// It is stored alongside the ciphertext so the key can be re-derived on read.
+const infoSize = commonSize
+
+// derivedKeyCacheSize bounds the number of derived AEADs kept in memory, amortizing the cost of HKDF across
+// repeated reads of the same record (for example, repeated GETs of the same Secret).
+const derivedKeyCacheSize = 256
+
+// gcm implements encryption at rest of the provided values given a cipher.Block algorithm.
+type gcm struct {
+	block cipher.Block
+}
+
+// NewGCMTransformer takes the given block cipher and performs encryption and decryption on the given data.
+func NewGCMTransformer(block cipher.Block) value.Transformer {
+	return &gcm{block: block}
+}
+
+func (t *gcm) TransformFromStorage(data []byte, context value.Context) ([]byte, bool, error) {
+	aead, err := cipher.NewGCM(t.block)
+	if err != nil {
+		return nil, false, err
+	}
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, false, fmt.Errorf("the stored data was shorter than the required size")
+	}
+	result, err := aead.Open(nil, data[:nonceSize], data[nonceSize:], context.AuthenticatedData())
+	return result, false, err
+}
+
+func (t *gcm) TransformToStorage(data []byte, context value.Context) ([]byte, error) {
+	aead, err := cipher.NewGCM(t.block)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := aead.NonceSize()
+	result := make([]byte, nonceSize+aead.Overhead()+len(data))
+	n, err := rand.Read(result[:nonceSize])
+	if err != nil || n != nonceSize {
+		return nil, err
+	}
+	cipherText := aead.Seal(result[nonceSize:nonceSize], result[:nonceSize], data, context.AuthenticatedData())
+	return result[:nonceSize+len(cipherText)], nil
+}
+
+// extendedNonceGCM avoids the ~2^32 encryption ceiling of a single AES-GCM key by never reusing the same
+// key across records: a fresh random "info" value is generated per TransformToStorage call and used, along
+// with the caller-supplied seed as HKDF-SHA256 input key material, to derive a one-off AES key. Because each
+// record is encrypted under its own key, the birthday bound on the 96-bit random nonce no longer bounds the
+// number of records a single seed (DEK) can safely protect.
+type extendedNonceGCM struct {
+	seed  []byte
+	cache *utilcache.LRUExpireCache
+}
+
+// NewHKDFExtendedNonceGCMTransformer takes a cryptographically strong seed of at least
+// MinSeedSizeExtendedNonceGCM bytes and returns a Transformer that derives a unique AES-256 key per record via
+// HKDF-SHA256, removing the write ceiling that a single static AES-GCM key is subject to. The seed plays the
+// role of HKDF input key material (IKM); it is never used directly as an AES key.
+func NewHKDFExtendedNonceGCMTransformer(seed []byte) (value.Transformer, error) {
+	if len(seed) < MinSeedSizeExtendedNonceGCM {
+		return nil, fmt.Errorf("seed must be at least %d bytes, got %d", MinSeedSizeExtendedNonceGCM, len(seed))
+	}
+	return &extendedNonceGCM{
+		seed:  append([]byte(nil), seed...),
+		cache: utilcache.NewLRUExpireCache(derivedKeyCacheSize),
+	}, nil
+}
+
+func (t *extendedNonceGCM) deriveAEAD(info []byte) (cipher.AEAD, error) {
+	if cached, ok := t.cache.Get(string(info)); ok {
+		return cached.(cipher.AEAD), nil
+	}
+	derivedKey := make([]byte, commonSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, t.seed, nil, info), derivedKey); err != nil {
+		return nil, fmt.Errorf("failed to derive encryption key from seed: %w", err)
+	}
+	block, err := aes.NewCipher(derivedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// the cache is keyed by info (not by the never-reused derived key) purely to let repeated reads of the
+	// same stored record skip re-deriving the key; entries naturally age out as new records are read.
+	t.cache.Add(string(info), aead, 1*time.Hour)
+	return aead, nil
+}
+
+func (t *extendedNonceGCM) TransformFromStorage(data []byte, context value.Context) ([]byte, bool, error) {
+	if len(data) < infoSize {
+		return nil, false, fmt.Errorf("the stored data was shorter than the required size")
+	}
+	info, rest := data[:infoSize], data[infoSize:]
+	aead, err := t.deriveAEAD(info)
+	if err != nil {
+		return nil, false, err
+	}
+	nonceSize := aead.NonceSize()
+	if len(rest) < nonceSize {
+		return nil, false, fmt.Errorf("the stored data was shorter than the required size")
+	}
+	result, err := aead.Open(nil, rest[:nonceSize], rest[nonceSize:], context.AuthenticatedData())
+	return result, false, err
+}
+
+func (t *extendedNonceGCM) TransformToStorage(data []byte, context value.Context) ([]byte, error) {
+	info := make([]byte, infoSize)
+	if _, err := rand.Read(info); err != nil {
+		return nil, err
+	}
+	aead, err := t.deriveAEAD(info)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := aead.NonceSize()
+	result := make([]byte, infoSize+nonceSize+aead.Overhead()+len(data))
+	n := copy(result, info)
+	if _, err := rand.Read(result[n : n+nonceSize]); err != nil {
+		return nil, err
+	}
+	nonce := result[n : n+nonceSize]
+	cipherText := aead.Seal(result[n+nonceSize:n+nonceSize], nonce, data, context.AuthenticatedData())
+	return result[:n+nonceSize+len(cipherText)], nil
+}
@@ -144,6 +144,163 @@ func benchmarkGCMRead(b *testing.B, keyLength int, valueLength int, stale bool)
 	b.StopTimer()
 }
 
+func TestExtendedNonceGCMKeyRotation(t *testing.T) {
+	testErr := fmt.Errorf("test error")
+	seed1 := bytes.Repeat([]byte("a"), MinSeedSizeExtendedNonceGCM)
+	seed2 := bytes.Repeat([]byte("b"), MinSeedSizeExtendedNonceGCM)
+	transformer1, err := NewHKDFExtendedNonceGCMTransformer(seed1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer2, err := NewHKDFExtendedNonceGCMTransformer(seed2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	p := value.NewPrefixTransformers(testErr,
+		value.PrefixTransformer{Prefix: []byte("first:"), Transformer: transformer1},
+		value.PrefixTransformer{Prefix: []byte("second:"), Transformer: transformer2},
+	)
+	out, err := p.TransformToStorage([]byte("firstvalue"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out, []byte("first:")) {
+		t.Fatalf("unexpected prefix: %q", out)
+	}
+	from, stale, err := p.TransformFromStorage(out, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale || !bytes.Equal([]byte("firstvalue"), from) {
+		t.Fatalf("unexpected data: %t %q", stale, from)
+	}
+
+	// verify changing the context fails storage
+	if _, _, err = p.TransformFromStorage(out, value.DefaultContext([]byte("incorrect_context"))); err == nil {
+		t.Fatalf("expected unauthenticated data")
+	}
+
+	// reverse the order, use the second key
+	p = value.NewPrefixTransformers(testErr,
+		value.PrefixTransformer{Prefix: []byte("second:"), Transformer: transformer2},
+		value.PrefixTransformer{Prefix: []byte("first:"), Transformer: transformer1},
+	)
+	from, stale, err = p.TransformFromStorage(out, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale || !bytes.Equal([]byte("firstvalue"), from) {
+		t.Fatalf("unexpected data: %t %q", stale, from)
+	}
+}
+
+func TestExtendedNonceGCMCompatibleWithPlainGCMPrefixRotation(t *testing.T) {
+	block, err := aes.NewCipher(bytes.Repeat([]byte("c"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	extended, err := NewHKDFExtendedNonceGCMTransformer(bytes.Repeat([]byte("d"), MinSeedSizeExtendedNonceGCM))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	// write with the plain GCM transformer while the extended-nonce transformer is merely available for reads
+	p := value.NewPrefixTransformers(fmt.Errorf("test error"),
+		value.PrefixTransformer{Prefix: []byte("gcm:"), Transformer: NewGCMTransformer(block)},
+		value.PrefixTransformer{Prefix: []byte("extgcm:"), Transformer: extended},
+	)
+	out, err := p.TransformToStorage([]byte("rotatable"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, stale, err := p.TransformFromStorage(out, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale || !bytes.Equal([]byte("rotatable"), from) {
+		t.Fatalf("unexpected data: %t %q", stale, from)
+	}
+
+	// now promote the extended-nonce transformer to the write path and confirm the previously written,
+	// plain-GCM-encrypted value is still readable (and reported stale so it gets rewritten)
+	p = value.NewPrefixTransformers(fmt.Errorf("test error"),
+		value.PrefixTransformer{Prefix: []byte("extgcm:"), Transformer: extended},
+		value.PrefixTransformer{Prefix: []byte("gcm:"), Transformer: NewGCMTransformer(block)},
+	)
+	from, stale, err = p.TransformFromStorage(out, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale || !bytes.Equal([]byte("rotatable"), from) {
+		t.Fatalf("unexpected data: %t %q", stale, from)
+	}
+
+	out2, err := p.TransformToStorage([]byte("rotatable2"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out2, []byte("extgcm:")) {
+		t.Fatalf("unexpected prefix: %q", out2)
+	}
+	from, stale, err = p.TransformFromStorage(out2, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale || !bytes.Equal([]byte("rotatable2"), from) {
+		t.Fatalf("unexpected data: %t %q", stale, from)
+	}
+}
+
+func BenchmarkExtendedNonceGCMRead_32_1024(b *testing.B)  { benchmarkExtendedNonceGCMRead(b, 1024) }
+func BenchmarkExtendedNonceGCMRead_32_16384(b *testing.B) { benchmarkExtendedNonceGCMRead(b, 16384) }
+
+func BenchmarkExtendedNonceGCMWrite_32_1024(b *testing.B)  { benchmarkExtendedNonceGCMWrite(b, 1024) }
+func BenchmarkExtendedNonceGCMWrite_32_16384(b *testing.B) { benchmarkExtendedNonceGCMWrite(b, 16384) }
+
+func benchmarkExtendedNonceGCMRead(b *testing.B, valueLength int) {
+	transformer, err := NewHKDFExtendedNonceGCMTransformer(bytes.Repeat([]byte("a"), MinSeedSizeExtendedNonceGCM))
+	if err != nil {
+		b.Fatal(err)
+	}
+	context := value.DefaultContext([]byte("authenticated_data"))
+	v := bytes.Repeat([]byte("0123456789abcdef"), valueLength/16)
+
+	out, err := transformer.TransformToStorage(v, context)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := transformer.TransformFromStorage(out, context); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
+
+func benchmarkExtendedNonceGCMWrite(b *testing.B, valueLength int) {
+	transformer, err := NewHKDFExtendedNonceGCMTransformer(bytes.Repeat([]byte("a"), MinSeedSizeExtendedNonceGCM))
+	if err != nil {
+		b.Fatal(err)
+	}
+	context := value.DefaultContext([]byte("authenticated_data"))
+	v := bytes.Repeat([]byte("0123456789abcdef"), valueLength/16)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := transformer.TransformToStorage(v, context); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
+
 func benchmarkGCMWrite(b *testing.B, keyLength int, valueLength int) {
 	block1, err := aes.NewCipher(bytes.Repeat([]byte("a"), keyLength))
 	if err != nil {
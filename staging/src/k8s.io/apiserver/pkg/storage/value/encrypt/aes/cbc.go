@@ -0,0 +1,134 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aes
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"k8s.io/apiserver/pkg/storage/value"
+)
+
+// hmacSize is the length in bytes of an HMAC-SHA256 tag.
+const hmacSize = sha256.Size
+
+// cbc implements encrypt-then-MAC encryption at rest using AES-CBC for confidentiality and HMAC-SHA256 for
+// integrity. It exists for FIPS and other regulated deployments that disallow GCM-family chaining modes, or
+// that simply want to avoid the short 96-bit random nonce that bounds how many records a single AES-GCM key
+// can safely encrypt (see the extended-nonce transformer in this package for the GCM-side answer to the same
+// problem).
+//
+// Storage layout: iv(16) || ciphertext || hmac(32), where ciphertext is the PKCS#7 padded plaintext encrypted
+// under AES-CBC with the given iv, and hmac is computed over iv || ciphertext || the caller's authenticated
+// data, in that order.
+type cbc struct {
+	block   cipher.Block
+	hmacKey []byte
+}
+
+// NewCBCTransformer takes the given block cipher and HMAC key and performs encrypt-then-MAC encryption and
+// decryption on the given data. The hmacKey should be at least sha256.Size bytes and independent of any key
+// material used to derive block.
+func NewCBCTransformer(block cipher.Block, hmacKey []byte) value.Transformer {
+	return &cbc{block: block, hmacKey: append([]byte(nil), hmacKey...)}
+}
+
+func (t *cbc) newHMAC() hash.Hash {
+	return hmac.New(sha256.New, t.hmacKey)
+}
+
+func (t *cbc) TransformFromStorage(data []byte, context value.Context) ([]byte, bool, error) {
+	blockSize := t.block.BlockSize()
+	if len(data) < blockSize+hmacSize {
+		return nil, false, fmt.Errorf("the stored data was shorter than the required size")
+	}
+
+	iv := data[:blockSize]
+	ciphertext := data[blockSize : len(data)-hmacSize]
+	receivedMAC := data[len(data)-hmacSize:]
+
+	mac := t.newHMAC()
+	mac.Write(data[:len(data)-hmacSize])
+	mac.Write(context.AuthenticatedData())
+	expectedMAC := mac.Sum(nil)
+	if !hmac.Equal(expectedMAC, receivedMAC) {
+		return nil, false, fmt.Errorf("invalid MAC, data may be corrupt or tampered with")
+	}
+
+	if len(ciphertext) == 0 || len(ciphertext)%blockSize != 0 {
+		return nil, false, fmt.Errorf("invalid buffer, size must be a multiple of the block size")
+	}
+	result := make([]byte, len(ciphertext))
+	mode := cipher.NewCBCDecrypter(t.block, iv)
+	mode.CryptBlocks(result, ciphertext)
+
+	result, err := pkcs7Unpad(result, blockSize)
+	if err != nil {
+		return nil, false, err
+	}
+	return result, false, nil
+}
+
+func (t *cbc) TransformToStorage(data []byte, context value.Context) ([]byte, error) {
+	blockSize := t.block.BlockSize()
+	padded := pkcs7Pad(data, blockSize)
+
+	result := make([]byte, blockSize+len(padded)+hmacSize)
+	iv := result[:blockSize]
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	ciphertext := result[blockSize : blockSize+len(padded)]
+	mode := cipher.NewCBCEncrypter(t.block, iv)
+	mode.CryptBlocks(ciphertext, padded)
+
+	mac := t.newHMAC()
+	mac.Write(result[:blockSize+len(padded)])
+	mac.Write(context.AuthenticatedData())
+	copy(result[blockSize+len(padded):], mac.Sum(nil))
+
+	return result, nil
+}
+
+// pkcs7Pad appends PKCS#7 padding so that len(data) is a multiple of blockSize.
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	padLen := blockSize - len(data)%blockSize
+	padding := bytes.Repeat([]byte{byte(padLen)}, padLen)
+	return append(append([]byte(nil), data...), padding...)
+}
+
+// pkcs7Unpad strips and validates PKCS#7 padding.
+func pkcs7Unpad(data []byte, blockSize int) ([]byte, error) {
+	if len(data) == 0 || len(data)%blockSize != 0 {
+		return nil, fmt.Errorf("invalid padding on input")
+	}
+	padLen := int(data[len(data)-1])
+	if padLen == 0 || padLen > blockSize || padLen > len(data) {
+		return nil, fmt.Errorf("invalid padding on input")
+	}
+	padding := data[len(data)-padLen:]
+	if !bytes.Equal(padding, bytes.Repeat([]byte{byte(padLen)}, padLen)) {
+		return nil, fmt.Errorf("invalid padding on input")
+	}
+	return data[:len(data)-padLen], nil
+}
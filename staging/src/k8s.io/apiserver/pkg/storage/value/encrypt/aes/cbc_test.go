@@ -0,0 +1,187 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"k8s.io/apiserver/pkg/storage/value"
+)
+
+func TestCBCKeyRotation(t *testing.T) {
+	testErr := fmt.Errorf("test error")
+	block1, err := aes.NewCipher([]byte("abcdefghijklmnop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block2, err := aes.NewCipher([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	p := value.NewPrefixTransformers(testErr,
+		value.PrefixTransformer{Prefix: []byte("first:"), Transformer: NewCBCTransformer(block1, []byte("hmac-key-one"))},
+		value.PrefixTransformer{Prefix: []byte("second:"), Transformer: NewCBCTransformer(block2, []byte("hmac-key-two"))},
+	)
+	out, err := p.TransformToStorage([]byte("firstvalue"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out, []byte("first:")) {
+		t.Fatalf("unexpected prefix: %q", out)
+	}
+	from, stale, err := p.TransformFromStorage(out, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale || !bytes.Equal([]byte("firstvalue"), from) {
+		t.Fatalf("unexpected data: %t %q", stale, from)
+	}
+
+	// verify changing the context fails storage
+	if _, _, err = p.TransformFromStorage(out, value.DefaultContext([]byte("incorrect_context"))); err == nil {
+		t.Fatalf("expected unauthenticated data")
+	}
+
+	// reverse the order, use the second key
+	p = value.NewPrefixTransformers(testErr,
+		value.PrefixTransformer{Prefix: []byte("second:"), Transformer: NewCBCTransformer(block2, []byte("hmac-key-two"))},
+		value.PrefixTransformer{Prefix: []byte("first:"), Transformer: NewCBCTransformer(block1, []byte("hmac-key-one"))},
+	)
+	from, stale, err = p.TransformFromStorage(out, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale || !bytes.Equal([]byte("firstvalue"), from) {
+		t.Fatalf("unexpected data: %t %q", stale, from)
+	}
+}
+
+func TestCBCTamperedMACRejected(t *testing.T) {
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer := NewCBCTransformer(block, []byte("hmac-key"))
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	out, err := transformer.TransformToStorage([]byte("secret-value"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte(nil), out...)
+	tampered[len(tampered)-1] ^= 0xFF
+	if _, _, err := transformer.TransformFromStorage(tampered, context); err == nil {
+		t.Fatalf("expected MAC verification to fail on tampered data")
+	}
+
+	tamperedCiphertext := append([]byte(nil), out...)
+	tamperedCiphertext[aes.BlockSize] ^= 0xFF
+	if _, _, err := transformer.TransformFromStorage(tamperedCiphertext, context); err == nil {
+		t.Fatalf("expected MAC verification to fail on tampered ciphertext")
+	}
+}
+
+func TestCBCRotationFromGCM(t *testing.T) {
+	gcmBlock, err := aes.NewCipher(bytes.Repeat([]byte("a"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbcBlock, err := aes.NewCipher(bytes.Repeat([]byte("b"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	// data written under aesgcm: must remain readable once aescbc: becomes the write path
+	p := value.NewPrefixTransformers(fmt.Errorf("test error"),
+		value.PrefixTransformer{Prefix: []byte("aesgcm:"), Transformer: NewGCMTransformer(gcmBlock)},
+	)
+	out, err := p.TransformToStorage([]byte("rotating-value"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p = value.NewPrefixTransformers(fmt.Errorf("test error"),
+		value.PrefixTransformer{Prefix: []byte("aescbc:"), Transformer: NewCBCTransformer(cbcBlock, []byte("hmac-key"))},
+		value.PrefixTransformer{Prefix: []byte("aesgcm:"), Transformer: NewGCMTransformer(gcmBlock)},
+	)
+	from, stale, err := p.TransformFromStorage(out, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale || !bytes.Equal([]byte("rotating-value"), from) {
+		t.Fatalf("unexpected data: %t %q", stale, from)
+	}
+
+	out2, err := p.TransformToStorage([]byte("rotated-value"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out2, []byte("aescbc:")) {
+		t.Fatalf("unexpected prefix: %q", out2)
+	}
+}
+
+// TestCBCKnownAnswer pins the exact bytes of the stored layout (iv || ciphertext || hmac) for a fixed
+// key/iv/plaintext/AAD combination, so that a change to the padding scheme, block mode, or MAC input ordering
+// is caught even if it happens to still round-trip through this package's own TransformFromStorage. The
+// expected ciphertext and HMAC were computed independently with openssl (enc -aes-256-cbc -nopad and
+// dgst -sha256 -mac HMAC) rather than derived from this implementation.
+func TestCBCKnownAnswer(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	iv := bytes.Repeat([]byte{0x24}, 16)
+	hmacKey := bytes.Repeat([]byte{0x99}, 32)
+	wantCiphertext := mustDecodeHex(t, "335a44d19d4bfcb630d0197b4e78db2f")
+	wantHMAC := mustDecodeHex(t, "4de96cfcaa989980b2e4d21dccdbf9dbc31384988c06b43dbfd6d6ca82969241")
+
+	stored := append(append(append([]byte(nil), iv...), wantCiphertext...), wantHMAC...)
+	if len(stored) != 64 {
+		t.Fatalf("unexpected known-answer vector length %d, want 64", len(stored))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer := &cbc{block: block, hmacKey: hmacKey}
+	context := value.DefaultContext([]byte("context"))
+
+	from, stale, err := transformer.TransformFromStorage(stored, context)
+	if err != nil {
+		t.Fatalf("known-answer vector failed to decrypt/authenticate, a layout or padding regression is likely: %v", err)
+	}
+	if stale || !bytes.Equal([]byte("known-plaintext"), from) {
+		t.Fatalf("unexpected data: %t %q", stale, from)
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
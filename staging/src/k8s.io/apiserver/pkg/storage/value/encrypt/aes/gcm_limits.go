@@ -0,0 +1,191 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aes
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/apiserver/pkg/storage/value"
+)
+
+// DefaultGCMWriteLimit is the default number of encryptions a gcmWithLimits transformer will perform under a
+// single cipher.Block before refusing further writes. It matches the birthday bound for a 96-bit random
+// nonce: past roughly 2^32 encryptions under one key, the probability of a nonce collision (and the
+// catastrophic loss of confidentiality and authenticity that follows) becomes unacceptably high.
+const DefaultGCMWriteLimit = 1 << 32
+
+// ErrGCMWriteLimitExceeded is returned by a write-limited GCM transformer once it has performed
+// DefaultGCMWriteLimit (or a caller-supplied limit) encryptions under the same key. Callers should treat this
+// as fail-closed: the key must be rotated before further writes can be accepted.
+var ErrGCMWriteLimitExceeded = fmt.Errorf("aes-gcm write limit exceeded for this key, rotation is required")
+
+// bloomFilterBits sizes each generation of the nonce-reuse Bloom filter at 16 Mib (2 MiB resident), enough to
+// track a generation's worth of observed nonces (see bloomFilterRotateAfter) with a low false-positive rate.
+const bloomFilterBits = 1 << 24
+
+// bloomFilterHashes is the number of bit positions set per observed nonce.
+const bloomFilterHashes = 4
+
+// bloomFilterRotateAfter bounds how many nonces a single Bloom filter generation will absorb before the
+// detector rotates to a fresh generation, discarding the oldest one. Without rotation a long-lived process
+// would eventually saturate the filter and every subsequent nonce would report as "seen", turning the
+// collision metric into noise; rotation keeps the detector bounded to a recent window of writes.
+const bloomFilterRotateAfter = 1 << 20
+
+// gcmWithLimits wraps the AES-GCM transformer with a hard cap on the number of encryptions performed under
+// the wrapped cipher.Block, and an opportunistic Bloom filter that flags a freshly generated nonce that
+// collides with one generated earlier under the same key. Nonces are only ever observed on the write path:
+// reads of previously written data are not nonce reuse, however often the same object is re-read.
+type gcmWithLimits struct {
+	// writes is accessed atomically and kept first in the struct for correct alignment on 32-bit platforms.
+	writes     uint64
+	block      cipher.Block
+	writeLimit uint64
+	seen       *nonceBloomFilter
+}
+
+// NewGCMTransformerWithLimits is identical to NewGCMTransformer except that it refuses to perform more than
+// writeLimit encryptions under the given cipher.Block, returning ErrGCMWriteLimitExceeded once the limit is
+// reached, and maintains a best-effort Bloom filter of nonces generated on the write path so that reuse can
+// be surfaced as a metric. A writeLimit of 0 selects DefaultGCMWriteLimit.
+func NewGCMTransformerWithLimits(block cipher.Block, writeLimit uint64) value.Transformer {
+	if writeLimit == 0 {
+		writeLimit = DefaultGCMWriteLimit
+	}
+	return &gcmWithLimits{
+		block:      block,
+		writeLimit: writeLimit,
+		seen:       newNonceBloomFilter(bloomFilterBits, bloomFilterRotateAfter),
+	}
+}
+
+func (t *gcmWithLimits) TransformToStorage(data []byte, context value.Context) ([]byte, error) {
+	if atomic.AddUint64(&t.writes, 1) > t.writeLimit {
+		return nil, ErrGCMWriteLimitExceeded
+	}
+	aead, err := cipher.NewGCM(t.block)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := aead.NonceSize()
+	result := make([]byte, nonceSize+aead.Overhead()+len(data))
+	n, err := rand.Read(result[:nonceSize])
+	if err != nil || n != nonceSize {
+		return nil, err
+	}
+	if t.seen.observe(result[:nonceSize]) {
+		gcmNonceCollisionsTotal.Inc()
+	}
+	cipherText := aead.Seal(result[nonceSize:nonceSize], result[:nonceSize], data, context.AuthenticatedData())
+	gcmWritesTotal.Inc()
+	return result[:nonceSize+len(cipherText)], nil
+}
+
+func (t *gcmWithLimits) TransformFromStorage(data []byte, context value.Context) ([]byte, bool, error) {
+	aead, err := cipher.NewGCM(t.block)
+	if err != nil {
+		return nil, false, err
+	}
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, false, fmt.Errorf("the stored data was shorter than the required size")
+	}
+	result, err := aead.Open(nil, data[:nonceSize], data[nonceSize:], context.AuthenticatedData())
+	return result, false, err
+}
+
+// nonceBloomFilter is a small, bounded, thread-safe Bloom filter used to opportunistically detect nonce
+// reuse under a single AES-GCM key. It holds at most two generations at a time: the active generation being
+// filled, and the previous one. A nonce is reported as seen if it appears in either. Once the active
+// generation has absorbed bloomFilterRotateAfter nonces, it becomes the previous generation and a fresh,
+// empty one takes over, so nonces observed more than two generations ago are forgotten rather than
+// saturating the filter. False positives are possible and acceptable here: a spurious collision metric is far
+// cheaper than silently missing a real one. False negatives are not possible for any nonce still within the
+// two most recent generations.
+type nonceBloomFilter struct {
+	mu          sync.Mutex
+	bits        int
+	k           int
+	rotateAfter int
+	active      *bloomGeneration
+	previous    *bloomGeneration
+}
+
+// bloomGeneration is a single fixed-size Bloom filter bitset along with the number of nonces inserted into
+// it so far.
+type bloomGeneration struct {
+	bits  []uint64
+	count int
+}
+
+func newBloomGeneration(bits int) *bloomGeneration {
+	return &bloomGeneration{bits: make([]uint64, bits/64)}
+}
+
+func (g *bloomGeneration) test(sum1, sum2 uint64, k int) bool {
+	totalBits := uint64(len(g.bits)) * 64
+	for i := 0; i < k; i++ {
+		idx := (sum1 + uint64(i)*sum2) % totalBits
+		word, bit := idx/64, idx%64
+		if g.bits[word]&(1<<bit) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *bloomGeneration) set(sum1, sum2 uint64, k int) {
+	totalBits := uint64(len(g.bits)) * 64
+	for i := 0; i < k; i++ {
+		idx := (sum1 + uint64(i)*sum2) % totalBits
+		word, bit := idx/64, idx%64
+		g.bits[word] |= 1 << bit
+	}
+}
+
+// newNonceBloomFilter returns a nonceBloomFilter with bits bits per generation, rotating to a fresh
+// generation every rotateAfter inserts.
+func newNonceBloomFilter(bits, rotateAfter int) *nonceBloomFilter {
+	return &nonceBloomFilter{bits: bits, k: bloomFilterHashes, rotateAfter: rotateAfter, active: newBloomGeneration(bits)}
+}
+
+// observe records nonce as seen in the active generation and reports whether it (or a colliding set of hash
+// positions) was already present in the active or previous generation.
+func (f *nonceBloomFilter) observe(nonce []byte) bool {
+	h := fnv.New64a()
+	h.Write(nonce)
+	sum1 := h.Sum64()
+	// cheap second hash via the Kirsch-Mitzenmacher technique, avoiding a second pass over nonce
+	sum2 := sum1*0x9e3779b97f4a7c15 + 1
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	seen := f.active.test(sum1, sum2, f.k) || (f.previous != nil && f.previous.test(sum1, sum2, f.k))
+	f.active.set(sum1, sum2, f.k)
+	f.active.count++
+	if f.active.count >= f.rotateAfter {
+		f.previous = f.active
+		f.active = newBloomGeneration(f.bits)
+	}
+	return seen
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"k8s.io/apiserver/pkg/storage/value"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestGCMWriteLimitFailsClosed(t *testing.T) {
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer := NewGCMTransformerWithLimits(block, 2)
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	for i := 0; i < 2; i++ {
+		if _, err := transformer.TransformToStorage([]byte("value"), context); err != nil {
+			t.Fatalf("write %d: unexpected error: %v", i, err)
+		}
+	}
+
+	if _, err := transformer.TransformToStorage([]byte("value"), context); !errors.Is(err, ErrGCMWriteLimitExceeded) {
+		t.Fatalf("expected ErrGCMWriteLimitExceeded, got %v", err)
+	}
+	// the limit is permanent for this transformer instance until the key is rotated
+	if _, err := transformer.TransformToStorage([]byte("value"), context); !errors.Is(err, ErrGCMWriteLimitExceeded) {
+		t.Fatalf("expected ErrGCMWriteLimitExceeded to persist, got %v", err)
+	}
+}
+
+func TestGCMWriteLimitDefault(t *testing.T) {
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer := NewGCMTransformerWithLimits(block, 0).(*gcmWithLimits)
+	if transformer.writeLimit != DefaultGCMWriteLimit {
+		t.Fatalf("expected default write limit %d, got %d", DefaultGCMWriteLimit, transformer.writeLimit)
+	}
+}
+
+func TestGCMReReadDoesNotTriggerNonceCollisionMetric(t *testing.T) {
+	gcmNonceCollisionsTotal.Reset()
+
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer := NewGCMTransformerWithLimits(block, DefaultGCMWriteLimit)
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	out, err := transformer.TransformToStorage([]byte("value"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// re-reading the same stored object happens constantly in a live apiserver (get/list/watch cache
+	// fills) and must never be mistaken for nonce reuse: nonces are only ever observed on the write path,
+	// where generating the same random nonce twice would actually be a problem.
+	for i := 0; i < 5; i++ {
+		if _, _, err := transformer.TransformFromStorage(out, context); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(gcmNonceCollisionsTotal); got != 0 {
+		t.Fatalf("expected re-reads of the same object to never count as nonce collisions, got %v", got)
+	}
+}
+
+func TestGCMWritePathTracksGeneratedNonces(t *testing.T) {
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer := NewGCMTransformerWithLimits(block, DefaultGCMWriteLimit).(*gcmWithLimits)
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	out, err := transformer.TransformToStorage([]byte("value"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := out[:aead.NonceSize()]
+
+	// the nonce generated by the write above was already recorded by the detector as part of
+	// TransformToStorage; observing it again simulates what happens if crypto/rand produced the same nonce
+	// for a second write under this key, and confirms the write path is what actually feeds the detector.
+	if !transformer.seen.observe(nonce) {
+		t.Fatalf("expected the write path's generated nonce to already be tracked by the collision detector")
+	}
+}
+
+func TestNonceBloomFilterDetectsRepeats(t *testing.T) {
+	f := newNonceBloomFilter(bloomFilterBits, bloomFilterRotateAfter)
+	nonce := []byte("123456789012")
+
+	if f.observe(nonce) {
+		t.Fatalf("expected first observation to report unseen")
+	}
+	if !f.observe(nonce) {
+		t.Fatalf("expected second observation of the same nonce to report seen")
+	}
+	if f.observe([]byte("different12!")) {
+		t.Fatalf("expected a distinct nonce to report unseen")
+	}
+}
+
+func TestNonceBloomFilterRotatesGenerations(t *testing.T) {
+	const rotateAfter = 4
+	f := newNonceBloomFilter(bloomFilterBits, rotateAfter)
+	nonce := []byte("123456789012")
+
+	if f.observe(nonce) {
+		t.Fatalf("expected first observation to report unseen")
+	}
+
+	// fill the active generation past its rotation threshold with distinct nonces; the original nonce must
+	// still be found via the previous generation immediately after rotation.
+	filler := make([]byte, 12)
+	for i := 0; i < rotateAfter; i++ {
+		binary.BigEndian.PutUint64(filler, uint64(i))
+		f.observe(filler)
+	}
+	if !f.observe(nonce) {
+		t.Fatalf("expected the original nonce to still be tracked via the previous generation right after rotation")
+	}
+
+	// push two more full generations through (the observe above re-inserted the original nonce into the
+	// active generation): the original nonce now predates both retained generations and must finally be
+	// forgotten, confirming the filter is bounded rather than growing without eviction.
+	for i := 0; i < 2*rotateAfter; i++ {
+		binary.BigEndian.PutUint64(filler, uint64(i))
+		f.observe(filler)
+	}
+	if f.observe(nonce) {
+		t.Fatalf("expected the original nonce to have been evicted after two full generations elapsed")
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aes
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	gcmWritesTotal = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      "apiserver",
+			Subsystem:      "storage_encryption",
+			Name:           "gcm_writes_total",
+			Help:           "Total number of AES-GCM encryption operations performed on values at rest by write-limited transformers, summed across all keys.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	gcmNonceCollisionsTotal = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      "apiserver",
+			Subsystem:      "storage_encryption",
+			Name:           "gcm_nonce_collisions_total",
+			Help:           "Total number of times a newly generated AES-GCM nonce collided with one generated earlier under the same key, as observed on the write path by a bounded, rotating Bloom filter. Reads of previously written data never contribute to this counter. Absent a Bloom filter false positive, a nonzero value indicates an actual nonce collision for writes still within the filter's recent-generation window.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(gcmWritesTotal)
+	legacyregistry.MustRegister(gcmNonceCollisionsTotal)
+}
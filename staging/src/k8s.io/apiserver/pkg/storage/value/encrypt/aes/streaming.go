@@ -0,0 +1,279 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aes
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"k8s.io/apiserver/pkg/storage/value"
+)
+
+// frameSize is the maximum number of plaintext bytes sealed into a single frame. Chunking bounds the memory
+// required to encrypt or decrypt a value to a small multiple of frameSize, regardless of the total value
+// size.
+const frameSize = 64 * 1024
+
+// noncePrefixSize is the length in bytes of the random prefix generated once per stream and written as the
+// stream header; it is combined with a per-frame counter to build each frame's AES-GCM nonce.
+const noncePrefixSize = 8
+
+// frameCounterSize is the length in bytes of the big-endian frame counter that, together with the stream's
+// noncePrefix, forms a 12-byte GCM nonce that is never reused within a stream.
+const frameCounterSize = 4
+
+// frameAADSize is the length of the additional authenticated data bound to every frame: the big-endian frame
+// index followed by a one-byte "is this the last frame" flag. Authenticating the index and the flag prevents
+// frames from being reordered, dropped, or truncated without detection.
+const frameAADSize = frameCounterSize + 1
+
+var _ value.StreamingTransformer = (*gcm)(nil)
+
+// WrapWriter returns a WriteCloser that splits data written to it into frameSize plaintext chunks, encrypts
+// each with a nonce derived from a random per-stream prefix and a monotonically increasing frame counter, and
+// writes the result to w. The frame index and a final-frame flag are authenticated as AAD so that truncating,
+// reordering, or splicing frames (including frames spliced in from a different stream) is detected as a
+// decryption failure rather than silently accepted.
+func (g *gcm) WrapWriter(w io.Writer, context value.Context) (io.WriteCloser, error) {
+	aead, err := cipher.NewGCM(g.block)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, fmt.Errorf("failed to write stream header: %w", err)
+	}
+	return &gcmStreamWriter{
+		w:           w,
+		aead:        aead,
+		noncePrefix: prefix,
+		context:     context,
+		buf:         make([]byte, 0, frameSize),
+	}, nil
+}
+
+// WrapReader returns a Reader that reverses WrapWriter: it reads the stream header written by WrapWriter,
+// then decrypts and authenticates each frame in order as the caller reads from it.
+func (g *gcm) WrapReader(r io.Reader, context value.Context) (io.Reader, error) {
+	aead, err := cipher.NewGCM(g.block)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("failed to read stream header: %w", err)
+	}
+	return &gcmStreamReader{
+		r:           r,
+		aead:        aead,
+		noncePrefix: prefix,
+		context:     context,
+	}, nil
+}
+
+// frameNonce builds the 12-byte GCM nonce for frame index idx: the stream's random prefix followed by idx
+// encoded big-endian. Because prefix is unique per stream and idx never repeats within a stream, the nonce
+// is never reused under the stream's derived use of the underlying key.
+func frameNonce(prefix []byte, idx uint32) []byte {
+	nonce := make([]byte, noncePrefixSize+frameCounterSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], idx)
+	return nonce
+}
+
+// frameAAD builds the additional authenticated data for frame index idx, binding in whether it is the final
+// frame of the stream.
+func frameAAD(idx uint32, last bool) []byte {
+	aad := make([]byte, frameAADSize)
+	binary.BigEndian.PutUint32(aad, idx)
+	if last {
+		aad[frameCounterSize] = 1
+	}
+	return aad
+}
+
+// gcmStreamWriter implements io.WriteCloser by buffering writes into frameSize chunks and sealing each as an
+// independent AES-GCM frame.
+type gcmStreamWriter struct {
+	w           io.Writer
+	aead        cipher.AEAD
+	noncePrefix []byte
+	context     value.Context
+	frameIndex  uint32
+	buf         []byte
+	closed      bool
+}
+
+func (s *gcmStreamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, fmt.Errorf("write to closed stream")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		if len(s.buf) == cap(s.buf) {
+			if err := s.sealFrame(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close seals and writes the final frame, which may be empty if the total plaintext was an exact multiple of
+// frameSize (or zero length). It must be called exactly once.
+func (s *gcmStreamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.sealFrame(true)
+}
+
+func (s *gcmStreamWriter) sealFrame(last bool) error {
+	nonce := frameNonce(s.noncePrefix, s.frameIndex)
+	aad := append(frameAAD(s.frameIndex, last), s.context.AuthenticatedData()...)
+	ciphertext := s.aead.Seal(nil, nonce, s.buf, aad)
+	if _, err := s.w.Write(ciphertext); err != nil {
+		return err
+	}
+	s.frameIndex++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// gcmStreamReader implements io.Reader by decrypting one frame at a time. Because a frame's AAD commits to
+// whether it is the last frame in the stream, gcmStreamReader must read one frame ahead of what it returns to
+// the caller: only once it knows whether a further frame follows can it pick the right AAD to authenticate
+// the frame it is about to return. Guessing wrong (for example, because the stream was truncated right after
+// a non-final frame) causes GCM authentication to fail.
+type gcmStreamReader struct {
+	r           io.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	context     value.Context
+	frameIndex  uint32
+
+	pending []byte // decrypted plaintext not yet returned to the caller
+
+	havePending       bool // a raw frame has been read but not yet decrypted
+	pendingCiphertext []byte
+	pendingFull       bool // pendingCiphertext was read in full: a further frame may follow, finality is unresolved
+
+	finished bool
+}
+
+func (s *gcmStreamReader) frameCiphertextSize() int {
+	return frameSize + s.aead.Overhead()
+}
+
+// readRawFrame reads up to one full-size ciphertext frame. full is true only if exactly frameCiphertextSize
+// bytes were read, meaning a further frame may follow.
+func (s *gcmStreamReader) readRawFrame() (raw []byte, full bool, err error) {
+	buf := make([]byte, s.frameCiphertextSize())
+	n, err := io.ReadFull(s.r, buf)
+	switch {
+	case err == nil:
+		return buf, true, nil
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return buf[:n], false, nil
+	default:
+		return nil, false, err
+	}
+}
+
+func (s *gcmStreamReader) decryptFrame(ciphertext []byte, last bool) ([]byte, error) {
+	nonce := frameNonce(s.noncePrefix, s.frameIndex)
+	aad := append(frameAAD(s.frameIndex, last), s.context.AuthenticatedData()...)
+	plain, err := s.aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt frame %d: %w", s.frameIndex, err)
+	}
+	s.frameIndex++
+	return plain, nil
+}
+
+func (s *gcmStreamReader) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.finished {
+			return 0, io.EOF
+		}
+		if err := s.advance(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// advance decrypts the next frame of plaintext into s.pending, resolving one step of the read-ahead needed to
+// know whether a given frame is the final one.
+func (s *gcmStreamReader) advance() error {
+	if !s.havePending {
+		raw, full, err := s.readRawFrame()
+		if err != nil {
+			return err
+		}
+		if !full && len(raw) == 0 {
+			return fmt.Errorf("truncated stream: missing final frame")
+		}
+		s.pendingCiphertext, s.pendingFull, s.havePending = raw, full, true
+	}
+
+	if !s.pendingFull {
+		// nothing can follow a short read: this is definitively the final frame
+		plain, err := s.decryptFrame(s.pendingCiphertext, true)
+		if err != nil {
+			return err
+		}
+		s.pending, s.finished, s.havePending = plain, true, false
+		return nil
+	}
+
+	// s.pendingCiphertext is a full-size frame of ambiguous finality; look one frame ahead to resolve it
+	next, full, err := s.readRawFrame()
+	if err != nil {
+		return err
+	}
+	if !full && len(next) == 0 {
+		// nothing follows: the buffered frame was the final one
+		plain, err := s.decryptFrame(s.pendingCiphertext, true)
+		if err != nil {
+			return err
+		}
+		s.pending, s.finished, s.havePending = plain, true, false
+		return nil
+	}
+	// something follows: the buffered frame was not final
+	plain, err := s.decryptFrame(s.pendingCiphertext, false)
+	if err != nil {
+		return err
+	}
+	s.pending = plain
+	s.pendingCiphertext, s.pendingFull, s.havePending = next, full, true
+	return nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"io"
+	"testing"
+
+	"k8s.io/apiserver/pkg/storage/value"
+)
+
+func mustEncryptStream(t testing.TB, transformer value.StreamingTransformer, context value.Context, plaintext []byte, chunkSize int) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := transformer.WrapWriter(&out, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(plaintext) > 0 {
+		n := chunkSize
+		if n > len(plaintext) {
+			n = len(plaintext)
+		}
+		if _, err := w.Write(plaintext[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plaintext = plaintext[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func newStreamingTestTransformer(t testing.TB) value.StreamingTransformer {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte("a"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewGCMTransformer(block).(value.StreamingTransformer)
+}
+
+func TestStreamingRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, frameSize - 1, frameSize, frameSize + 1, 3*frameSize + 17} {
+		transformer := newStreamingTestTransformer(t)
+		context := value.DefaultContext([]byte("authenticated_data"))
+		plaintext := bytes.Repeat([]byte{0x7a}, size)
+
+		ciphertext := mustEncryptStream(t, transformer, context, plaintext, 4096)
+
+		r, err := transformer.WrapReader(bytes.NewReader(ciphertext), context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("size %d: round trip mismatch: got %d bytes, want %d", size, len(got), len(plaintext))
+		}
+	}
+}
+
+func TestStreamingPartialReads(t *testing.T) {
+	transformer := newStreamingTestTransformer(t)
+	context := value.DefaultContext([]byte("authenticated_data"))
+	plaintext := bytes.Repeat([]byte{0x42}, 3*frameSize+100)
+
+	ciphertext := mustEncryptStream(t, transformer, context, plaintext, frameSize)
+
+	r, err := transformer.WrapReader(bytes.NewReader(ciphertext), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	buf := make([]byte, 17) // deliberately not frame-aligned
+	for {
+		n, err := r.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got.Bytes(), plaintext) {
+		t.Fatalf("partial-read round trip mismatch: got %d bytes, want %d", got.Len(), len(plaintext))
+	}
+}
+
+func TestStreamingTruncatedCiphertextRejected(t *testing.T) {
+	transformer := newStreamingTestTransformer(t)
+	context := value.DefaultContext([]byte("authenticated_data"))
+	plaintext := bytes.Repeat([]byte{0x11}, 2*frameSize+10)
+
+	ciphertext := mustEncryptStream(t, transformer, context, plaintext, frameSize)
+
+	// drop the final (short) frame: what remains looks like a complete stream of full frames, but the
+	// reader must detect that the last full frame was wrongly authenticated as non-final.
+	frameOnDisk := frameSize + 16 // AES-GCM tag overhead
+	truncated := ciphertext[:noncePrefixSize+2*frameOnDisk]
+
+	r, err := transformer.WrapReader(bytes.NewReader(truncated), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatalf("expected truncated stream to be rejected")
+	}
+}
+
+func TestStreamingSwappedFramesRejected(t *testing.T) {
+	transformer := newStreamingTestTransformer(t)
+	context := value.DefaultContext([]byte("authenticated_data"))
+	plaintext := bytes.Repeat([]byte{0x33}, 2*frameSize+10)
+
+	ciphertext := mustEncryptStream(t, transformer, context, plaintext, frameSize)
+
+	frameOnDisk := frameSize + 16
+	header := ciphertext[:noncePrefixSize]
+	frame0 := ciphertext[noncePrefixSize : noncePrefixSize+frameOnDisk]
+	frame1 := ciphertext[noncePrefixSize+frameOnDisk : noncePrefixSize+2*frameOnDisk]
+	rest := ciphertext[noncePrefixSize+2*frameOnDisk:]
+
+	swapped := append(append(append(append([]byte{}, header...), frame1...), frame0...), rest...)
+
+	r, err := transformer.WrapReader(bytes.NewReader(swapped), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatalf("expected swapped frames to be rejected")
+	}
+}
+
+func TestStreamingCrossObjectFrameSplicingRejected(t *testing.T) {
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	transformerA := newStreamingTestTransformer(t)
+	ciphertextA := mustEncryptStream(t, transformerA, context, bytes.Repeat([]byte{0xAA}, 2*frameSize), frameSize)
+
+	transformerB := newStreamingTestTransformer(t)
+	ciphertextB := mustEncryptStream(t, transformerB, context, bytes.Repeat([]byte{0xBB}, 2*frameSize), frameSize)
+
+	frameOnDisk := frameSize + 16
+	// splice object B's first frame into object A's stream, keeping A's header. Both transformers use the same
+	// key, so the spliced frame is rejected only because it was sealed under B's random nonce prefix, not A's.
+	spliced := append(append([]byte{}, ciphertextA[:noncePrefixSize]...), ciphertextB[noncePrefixSize:noncePrefixSize+frameOnDisk]...)
+	spliced = append(spliced, ciphertextA[noncePrefixSize+frameOnDisk:]...)
+
+	r, err := transformerA.WrapReader(bytes.NewReader(spliced), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatalf("expected a frame spliced in from a different object's stream to be rejected")
+	}
+}
+
+func BenchmarkStreamingWrite_1MiB(b *testing.B)  { benchmarkStreamingWrite(b, 1<<20) }
+func BenchmarkStreamingWrite_16MiB(b *testing.B) { benchmarkStreamingWrite(b, 16<<20) }
+
+func BenchmarkStreamingRead_1MiB(b *testing.B)  { benchmarkStreamingRead(b, 1<<20) }
+func BenchmarkStreamingRead_16MiB(b *testing.B) { benchmarkStreamingRead(b, 16<<20) }
+
+func benchmarkStreamingWrite(b *testing.B, size int) {
+	transformer := newStreamingTestTransformer(b)
+	context := value.DefaultContext([]byte("authenticated_data"))
+	plaintext := bytes.Repeat([]byte{0x01}, size)
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out bytes.Buffer
+		w, err := transformer.WrapWriter(&out, context)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkStreamingRead(b *testing.B, size int) {
+	transformer := newStreamingTestTransformer(b)
+	context := value.DefaultContext([]byte("authenticated_data"))
+	plaintext := bytes.Repeat([]byte{0x01}, size)
+	ciphertext := mustEncryptStream(b, transformer, context, plaintext, frameSize)
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := transformer.WrapReader(bytes.NewReader(ciphertext), context)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
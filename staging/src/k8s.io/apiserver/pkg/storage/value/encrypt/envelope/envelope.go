@@ -0,0 +1,165 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package envelope transforms values for storage at rest using a KMS-style envelope encryption scheme: each
+// object is encrypted under a freshly generated, per-object data encryption key (DEK), and the DEK itself is
+// wrapped ("enveloped") by a remote key management service so the apiserver never persists an unwrapped key.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/apiserver/pkg/storage/value"
+	aestransformer "k8s.io/apiserver/pkg/storage/value/encrypt/aes"
+)
+
+// DEKSize is the size in bytes of the per-object data encryption key generated for each TransformToStorage
+// call.
+const DEKSize = 32
+
+// DefaultCacheSize is the default number of decrypted DEKs kept in memory, keyed by their wrapped form, so
+// that reads of previously-seen objects do not require a round trip to the KMS.
+const DefaultCacheSize = 1000
+
+// dekCacheTTL bounds how long a decrypted DEK is kept in memory even if it continues to be read, limiting the
+// exposure of plaintext key material held outside the KMS.
+const dekCacheTTL = 1 * time.Hour
+
+// KMSService is implemented by a remote or local key management service capable of wrapping and unwrapping
+// data encryption keys on behalf of the envelope transformer. Implementations might call out to Vault, a
+// cloud provider's KMS, or a gRPC kms-plugin socket.
+type KMSService interface {
+	// Encrypt wraps the given plaintext DEK, returning opaque wrapped key material safe to persist to etcd.
+	Encrypt(data []byte) ([]byte, error)
+	// Decrypt unwraps previously wrapped key material, returning the plaintext DEK.
+	Decrypt(data []byte) ([]byte, error)
+}
+
+// HealthChecker may optionally be implemented by a KMSService to report its own liveness, for example the
+// state of a gRPC connection to an external kms-plugin socket. The apiserver uses this to surface KMS
+// unavailability through its standard healthz machinery.
+type HealthChecker interface {
+	Health() error
+}
+
+// KMSPrefix returns the PrefixTransformer prefix conventionally used to identify data encrypted by the named
+// KMS provider, allowing operators to rotate between KMS providers the same way they rotate between aesgcm
+// and aescbc.
+func KMSPrefix(providerName string) []byte {
+	return []byte(fmt.Sprintf("k8s:enc:kms:v1:%s:", providerName))
+}
+
+// envelopeTransformer implements value.Transformer using per-object DEKs wrapped by a KMSService.
+//
+// Stored blob format: varint(len(wrappedDEK)) || wrappedDEK || gcm(payload), where gcm(payload) is the
+// result of encrypting payload with aestransformer.NewGCMTransformer under the plaintext DEK.
+type envelopeTransformer struct {
+	envelopeService KMSService
+	cache           *utilcache.LRUExpireCache
+}
+
+// NewEnvelopeTransformer returns a value.Transformer that envelope-encrypts each value under a unique DEK
+// wrapped by envelopeService. cacheSize bounds the number of unwrapped DEKs kept in memory; a value <= 0
+// selects DefaultCacheSize.
+func NewEnvelopeTransformer(envelopeService KMSService, cacheSize int) value.Transformer {
+	if cacheSize <= 0 {
+		cacheSize = DefaultCacheSize
+	}
+	return &envelopeTransformer{
+		envelopeService: envelopeService,
+		cache:           utilcache.NewLRUExpireCache(cacheSize),
+	}
+}
+
+// Health returns the KMS backend's health check error, if envelopeService implements HealthChecker. A nil
+// return means either that the backend reported itself healthy, or that it does not implement HealthChecker,
+// in which case nil says nothing about whether the KMS is reachable.
+func (t *envelopeTransformer) Health() error {
+	if hc, ok := t.envelopeService.(HealthChecker); ok {
+		return hc.Health()
+	}
+	return nil
+}
+
+// dekTransformer returns the value.Transformer for the plaintext DEK, populating the cache on a miss.
+func (t *envelopeTransformer) dekTransformer(wrappedDEK []byte, unwrap func() ([]byte, error)) (value.Transformer, error) {
+	key := string(wrappedDEK)
+	if cached, ok := t.cache.Get(key); ok {
+		return cached.(value.Transformer), nil
+	}
+	dek, err := unwrap()
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, err
+	}
+	transformer := aestransformer.NewGCMTransformer(block)
+	t.cache.Add(key, transformer, dekCacheTTL)
+	return transformer, nil
+}
+
+func (t *envelopeTransformer) TransformFromStorage(data []byte, context value.Context) ([]byte, bool, error) {
+	wrappedDEKLen, n := binary.Varint(data)
+	if n <= 0 || wrappedDEKLen < 0 || int64(len(data)-n) < wrappedDEKLen {
+		return nil, false, fmt.Errorf("invalid envelope: could not decode wrapped DEK length")
+	}
+	wrappedDEK := data[n : n+int(wrappedDEKLen)]
+	payload := data[n+int(wrappedDEKLen):]
+
+	transformer, err := t.dekTransformer(wrappedDEK, func() ([]byte, error) {
+		return t.envelopeService.Decrypt(wrappedDEK)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return transformer.TransformFromStorage(payload, context)
+}
+
+func (t *envelopeTransformer) TransformToStorage(data []byte, context value.Context) ([]byte, error) {
+	dek := make([]byte, DEKSize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	wrappedDEK, err := t.envelopeService.Encrypt(dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data encryption key: %w", err)
+	}
+
+	transformer, err := t.dekTransformer(wrappedDEK, func() ([]byte, error) { return dek, nil })
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := transformer.TransformToStorage(data, context)
+	if err != nil {
+		return nil, err
+	}
+
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(lenBuf, int64(len(wrappedDEK)))
+
+	result := make([]byte, 0, n+len(wrappedDEK)+len(encrypted))
+	result = append(result, lenBuf[:n]...)
+	result = append(result, wrappedDEK...)
+	result = append(result, encrypted...)
+	return result, nil
+}
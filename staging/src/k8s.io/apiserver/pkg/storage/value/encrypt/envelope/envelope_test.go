@@ -0,0 +1,228 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"k8s.io/apiserver/pkg/storage/value"
+	aestransformer "k8s.io/apiserver/pkg/storage/value/encrypt/aes"
+)
+
+// fakeKMSService XORs with a fixed per-instance mask to simulate wrapping without real cryptography, and
+// counts how many times Encrypt/Decrypt were invoked so tests can assert on KMS cache behavior.
+type fakeKMSService struct {
+	mask         byte
+	encryptCalls int32
+	decryptCalls int32
+	healthErr    error
+}
+
+func (f *fakeKMSService) Encrypt(data []byte) ([]byte, error) {
+	atomic.AddInt32(&f.encryptCalls, 1)
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ f.mask
+	}
+	return out, nil
+}
+
+func (f *fakeKMSService) Decrypt(data []byte) ([]byte, error) {
+	atomic.AddInt32(&f.decryptCalls, 1)
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ f.mask
+	}
+	return out, nil
+}
+
+func (f *fakeKMSService) Health() error { return f.healthErr }
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	kms := &fakeKMSService{mask: 0x5A}
+	transformer := NewEnvelopeTransformer(kms, DefaultCacheSize)
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	out, err := transformer.TransformToStorage([]byte("super-secret"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, stale, err := transformer.TransformFromStorage(out, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale || !bytes.Equal([]byte("super-secret"), from) {
+		t.Fatalf("unexpected data: %t %q", stale, from)
+	}
+
+	if _, _, err := transformer.TransformFromStorage(out, value.DefaultContext([]byte("wrong"))); err == nil {
+		t.Fatalf("expected unauthenticated data")
+	}
+}
+
+func TestEnvelopeDEKCacheAvoidsRepeatedKMSCalls(t *testing.T) {
+	kms := &fakeKMSService{mask: 0x5A}
+	transformer := NewEnvelopeTransformer(kms, DefaultCacheSize)
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	out, err := transformer.TransformToStorage([]byte("value"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kms.decryptCalls != 0 {
+		t.Fatalf("expected no decrypt calls yet, got %d", kms.decryptCalls)
+	}
+	for i := 0; i < 5; i++ {
+		if _, _, err := transformer.TransformFromStorage(out, context); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the write above already cached the DEK under its wrapped form, so every read is served from the cache
+	if kms.decryptCalls != 0 {
+		t.Fatalf("expected reads of a value written through this transformer to need no KMS decrypt call, got %d", kms.decryptCalls)
+	}
+}
+
+func TestEnvelopeProviderRotation(t *testing.T) {
+	kmsV1 := &fakeKMSService{mask: 0x11}
+	kmsV2 := &fakeKMSService{mask: 0x22}
+	testErr := fmt.Errorf("test error")
+
+	p := value.NewPrefixTransformers(testErr,
+		value.PrefixTransformer{Prefix: KMSPrefix("v1"), Transformer: NewEnvelopeTransformer(kmsV1, DefaultCacheSize)},
+		value.PrefixTransformer{Prefix: KMSPrefix("v2"), Transformer: NewEnvelopeTransformer(kmsV2, DefaultCacheSize)},
+	)
+	context := value.DefaultContext([]byte("authenticated_data"))
+
+	out, err := p.TransformToStorage([]byte("firstvalue"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out, KMSPrefix("v1")) {
+		t.Fatalf("unexpected prefix: %q", out)
+	}
+
+	// rotate so v2 becomes the write path; data written under v1 must remain readable (and stale).
+	p = value.NewPrefixTransformers(testErr,
+		value.PrefixTransformer{Prefix: KMSPrefix("v2"), Transformer: NewEnvelopeTransformer(kmsV2, DefaultCacheSize)},
+		value.PrefixTransformer{Prefix: KMSPrefix("v1"), Transformer: NewEnvelopeTransformer(kmsV1, DefaultCacheSize)},
+	)
+	from, stale, err := p.TransformFromStorage(out, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale || !bytes.Equal([]byte("firstvalue"), from) {
+		t.Fatalf("unexpected data: %t %q", stale, from)
+	}
+}
+
+func TestEnvelopeHealth(t *testing.T) {
+	healthErr := fmt.Errorf("kms-plugin socket unreachable")
+	kms := &fakeKMSService{mask: 0x5A, healthErr: healthErr}
+	transformer := NewEnvelopeTransformer(kms, DefaultCacheSize).(*envelopeTransformer)
+
+	if err := transformer.Health(); err != healthErr {
+		t.Fatalf("expected health error to propagate, got %v", err)
+	}
+}
+
+func BenchmarkEnvelopeWrite_1024(b *testing.B)  { benchmarkEnvelopeWrite(b, 1024) }
+func BenchmarkEnvelopeWrite_16384(b *testing.B) { benchmarkEnvelopeWrite(b, 16384) }
+
+func BenchmarkEnvelopeRead_1024(b *testing.B)  { benchmarkEnvelopeRead(b, 1024) }
+func BenchmarkEnvelopeRead_16384(b *testing.B) { benchmarkEnvelopeRead(b, 16384) }
+
+func BenchmarkGCMWriteForComparison_1024(b *testing.B)  { benchmarkGCMWriteForComparison(b, 1024) }
+func BenchmarkGCMReadForComparison_1024(b *testing.B)   { benchmarkGCMReadForComparison(b, 1024) }
+
+func benchmarkEnvelopeWrite(b *testing.B, valueLength int) {
+	kms := &fakeKMSService{mask: 0x5A}
+	transformer := NewEnvelopeTransformer(kms, DefaultCacheSize)
+	context := value.DefaultContext([]byte("authenticated_data"))
+	v := bytes.Repeat([]byte("0123456789abcdef"), valueLength/16)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := transformer.TransformToStorage(v, context); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkEnvelopeRead(b *testing.B, valueLength int) {
+	kms := &fakeKMSService{mask: 0x5A}
+	transformer := NewEnvelopeTransformer(kms, DefaultCacheSize)
+	context := value.DefaultContext([]byte("authenticated_data"))
+	v := bytes.Repeat([]byte("0123456789abcdef"), valueLength/16)
+
+	out, err := transformer.TransformToStorage(v, context)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := transformer.TransformFromStorage(out, context); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkGCMWriteForComparison and benchmarkGCMReadForComparison give a baseline throughput number for the
+// raw GCM path in this chunk so the cost of envelope encryption's cached-DEK indirection can be judged.
+func benchmarkGCMWriteForComparison(b *testing.B, valueLength int) {
+	block, err := aes.NewCipher(bytes.Repeat([]byte("a"), 32))
+	if err != nil {
+		b.Fatal(err)
+	}
+	transformer := aestransformer.NewGCMTransformer(block)
+	context := value.DefaultContext([]byte("authenticated_data"))
+	v := bytes.Repeat([]byte("0123456789abcdef"), valueLength/16)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := transformer.TransformToStorage(v, context); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkGCMReadForComparison(b *testing.B, valueLength int) {
+	block, err := aes.NewCipher(bytes.Repeat([]byte("a"), 32))
+	if err != nil {
+		b.Fatal(err)
+	}
+	transformer := aestransformer.NewGCMTransformer(block)
+	context := value.DefaultContext([]byte("authenticated_data"))
+	v := bytes.Repeat([]byte("0123456789abcdef"), valueLength/16)
+
+	out, err := transformer.TransformToStorage(v, context)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := transformer.TransformFromStorage(out, context); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
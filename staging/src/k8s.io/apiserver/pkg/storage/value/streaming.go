@@ -0,0 +1,34 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package value
+
+import "io"
+
+// StreamingTransformer is implemented by transformers that can encrypt or decrypt a value of arbitrary size
+// without holding the entire plaintext or ciphertext in memory at once. It complements Transformer, which
+// buffers the whole value and remains the right choice for values small enough to do so; the storage layer
+// should pick whichever interface fits the size of the value being read or written.
+type StreamingTransformer interface {
+	// WrapReader returns a Reader that decrypts the data read from r, verifying the authenticity and
+	// ordering of the underlying ciphertext as part of the decode. Errors from the returned Reader, including
+	// truncation or reordering of the underlying stream, are reported through the usual io.Reader contract.
+	WrapReader(r io.Reader, context Context) (io.Reader, error)
+	// WrapWriter returns a WriteCloser that encrypts data written to it and writes the resulting ciphertext
+	// to w. Close must be called once writing is complete: it flushes and authenticates the final frame, and
+	// its return value must be checked.
+	WrapWriter(w io.Writer, context Context) (io.WriteCloser, error)
+}